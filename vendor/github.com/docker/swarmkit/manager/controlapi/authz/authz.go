@@ -0,0 +1,168 @@
+// Package authz lets third-party plugins veto controlapi RPCs before (and
+// after) they run, mirroring the AuthZ plugin hook the docker daemon
+// already exposes for the Engine API. Without it, any TLS peer holding a
+// role that's allowed to call a given RPC can mutate the cluster; an authz
+// plugin gives operators a place to layer their own policy on top of that.
+//
+// The plugin names to invoke belong in the cluster spec, so the list
+// replicates to every manager over raft rather than living only on
+// whichever manager started the interceptor. This tree only vendors
+// manager/controlapi, not api.ClusterSpec itself, so ClusterAuthorizationSpec
+// stands in for the field that belongs there until the proto definitions
+// can be updated; NewFromClusterSpec is the constructor controlapi's
+// cluster reconciliation should call once that field exists.
+//
+// This package is not wired into a running manager yet: the grpc.Server
+// construction that would install (*Authorizer).UnaryServerInterceptor via
+// grpc.UnaryInterceptor lives in manager/server.go, which this tree also
+// doesn't vendor. Until that call site exists and is updated, an Authorizer
+// built here has no effect on any RPC.
+package authz
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/docker/docker/pkg/authorization"
+	"github.com/docker/docker/pkg/plugingetter"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Authorizer runs every mutating controlapi RPC past a fixed, ordered list
+// of authorization plugins before allowing it through.
+type Authorizer struct {
+	pg      plugingetter.PluginGetter
+	plugins []string
+}
+
+// New validates that every name in plugins resolves to an installed, non-V1
+// plugin implementing the authorization.AuthZApiImplements capability, and
+// returns an Authorizer that enforces all of them, in order, on every
+// mutating RPC.
+func New(pg plugingetter.PluginGetter, plugins []string) (*Authorizer, error) {
+	for _, name := range plugins {
+		if err := validateAuthzPlugin(pg, name); err != nil {
+			return nil, err
+		}
+	}
+	return &Authorizer{pg: pg, plugins: plugins}, nil
+}
+
+// ClusterAuthorizationSpec is the part of the cluster spec that configures
+// this package: the ordered list of authorization plugin names every
+// manager should enforce. It mirrors the api.ClusterSpec.Authorization
+// field the full swarmkit proto would carry this on.
+type ClusterAuthorizationSpec struct {
+	Plugins []string
+}
+
+// NewFromClusterSpec reads the plugin chain out of spec, as persisted on
+// the cluster object, instead of taking a bare argument. Once
+// api.ClusterSpec grows the equivalent field, the manager's cluster
+// reconciliation loop should call this (re-building the Authorizer
+// whenever the cluster spec's plugin list changes) rather than New
+// directly, so the chain installed on a manager always matches what
+// replicated over raft.
+func NewFromClusterSpec(pg plugingetter.PluginGetter, spec ClusterAuthorizationSpec) (*Authorizer, error) {
+	return New(pg, spec.Plugins)
+}
+
+func validateAuthzPlugin(pg plugingetter.PluginGetter, name string) error {
+	if name == "" {
+		return grpc.Errorf(codes.InvalidArgument, "authorization plugin name must not be empty")
+	}
+	if pg == nil {
+		return grpc.Errorf(codes.InvalidArgument, "authorization plugin %s not supported", name)
+	}
+
+	p, err := pg.Get(name, authorization.AuthZApiImplements, plugingetter.Lookup)
+	if err != nil {
+		return grpc.Errorf(codes.InvalidArgument, "error during lookup of authorization plugin %s", name)
+	}
+	if p.IsV1() {
+		return grpc.Errorf(codes.InvalidArgument, "legacy plugin %s of type %s is not supported as an authorization plugin", name, authorization.AuthZApiImplements)
+	}
+	return nil
+}
+
+// isMutatingMethod reports whether fullMethod is one of the Create/Update/
+// Remove RPCs that authz plugins should see. Reads (Get/List/Watch) are
+// left alone, same as the docker daemon's own AuthZ hook only guards
+// requests that change state.
+func isMutatingMethod(fullMethod string) bool {
+	method := fullMethod[strings.LastIndex(fullMethod, "/")+1:]
+	for _, prefix := range []string{"Create", "Update", "Remove"} {
+		if strings.HasPrefix(method, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// UnaryServerInterceptor is installed as a grpc.UnaryServerInterceptor in
+// front of the controlapi server. For every mutating RPC it calls
+// AuthZReq on each configured plugin before invoking the handler, and
+// AuthZRes on each (in reverse order) once the handler has a response; any
+// plugin denying the request short-circuits with codes.PermissionDenied.
+func (a *Authorizer) UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if len(a.plugins) == 0 || !isMutatingMethod(info.FullMethod) {
+		return handler(ctx, req)
+	}
+
+	reqBody, err := json.Marshal(req)
+	if err != nil {
+		return nil, grpc.Errorf(codes.Internal, "unable to marshal request for authorization: %v", err)
+	}
+
+	authReq := &authorization.Request{
+		RequestMethod: info.FullMethod,
+		RequestBody:   reqBody,
+	}
+	for _, name := range a.plugins {
+		if err := a.call(name, authorization.AuthZApiRequest, authReq); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := handler(ctx, req)
+
+	authRes := &authorization.Response{}
+	if err != nil {
+		authRes.Err = err.Error()
+	} else if respBody, merr := json.Marshal(resp); merr == nil {
+		authRes.ResponseBody = respBody
+	}
+	for i := len(a.plugins) - 1; i >= 0; i-- {
+		if cerr := a.call(a.plugins[i], authorization.AuthZApiResponse, authRes); cerr != nil {
+			return nil, cerr
+		}
+	}
+
+	return resp, err
+}
+
+// call resolves plugin name and invokes rpcMethod ("AuthZPlugin.AuthZReq"
+// or "AuthZPlugin.AuthZRes") on it, returning a codes.PermissionDenied
+// error if the plugin is unreachable or denies the request.
+func (a *Authorizer) call(name, rpcMethod string, args interface{}) error {
+	p, err := a.pg.Get(name, authorization.AuthZApiImplements, plugingetter.Lookup)
+	if err != nil {
+		return grpc.Errorf(codes.PermissionDenied, "authorization plugin %s is unavailable: %v", name, err)
+	}
+
+	client := p.Client()
+	if client == nil {
+		return grpc.Errorf(codes.PermissionDenied, "authorization plugin %s did not return an RPC client", name)
+	}
+
+	var res authorization.Response
+	if err := client.Call(rpcMethod, args, &res); err != nil {
+		return grpc.Errorf(codes.PermissionDenied, "authorization plugin %s returned an error: %v", name, err)
+	}
+	if !res.Allow {
+		return grpc.Errorf(codes.PermissionDenied, "request denied by authorization plugin %s: %s", name, res.Msg)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package authz
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/docker/docker/pkg/authorization"
+	"github.com/docker/docker/pkg/plugingetter"
+	"github.com/docker/docker/pkg/plugins"
+	"github.com/docker/go-connections/tlsconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+type fakePluginGetter struct{}
+
+func (fakePluginGetter) Get(name, capability string, mode int) (plugingetter.CompatPlugin, error) {
+	return nil, nil
+}
+func (fakePluginGetter) GetAllByCap(capability string) ([]plugingetter.CompatPlugin, error) {
+	return nil, nil
+}
+func (fakePluginGetter) GetAllManagedPluginsByCap(capability string) []plugingetter.CompatPlugin {
+	return nil
+}
+func (fakePluginGetter) Handle(capability string, callback func(string, *plugins.Client)) {}
+
+// fakeCompatPlugin wraps a real *plugins.Client pointed at a test HTTP
+// server, so tests can exercise the actual AuthZReq/AuthZRes wire format
+// instead of stubbing out a.call.
+type fakeCompatPlugin struct {
+	name   string
+	client *plugins.Client
+}
+
+func (p *fakeCompatPlugin) Client() *plugins.Client    { return p.client }
+func (p *fakeCompatPlugin) Name() string               { return p.name }
+func (p *fakeCompatPlugin) FullName() string           { return p.name }
+func (p *fakeCompatPlugin) BasePath() string           { return "" }
+func (p *fakeCompatPlugin) IsV1() bool                 { return false }
+func (p *fakeCompatPlugin) ScopedPath(s string) string { return s }
+
+// singlePluginGetter always resolves to the same plugin, regardless of the
+// name it's asked for.
+type singlePluginGetter struct {
+	plugin plugingetter.CompatPlugin
+}
+
+func (g singlePluginGetter) Get(name, capability string, mode int) (plugingetter.CompatPlugin, error) {
+	return g.plugin, nil
+}
+func (singlePluginGetter) GetAllByCap(capability string) ([]plugingetter.CompatPlugin, error) {
+	return nil, nil
+}
+func (singlePluginGetter) GetAllManagedPluginsByCap(capability string) []plugingetter.CompatPlugin {
+	return nil
+}
+func (singlePluginGetter) Handle(capability string, callback func(string, *plugins.Client)) {}
+
+func newTestAuthzPlugin(t *testing.T, handler http.HandlerFunc) (*Authorizer, func()) {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+
+	client, err := plugins.NewClient(srv.URL, &tlsconfig.Options{InsecureSkipVerify: true})
+	require.NoError(t, err)
+
+	pg := singlePluginGetter{plugin: &fakeCompatPlugin{name: "test-authz", client: client}}
+	a, err := New(pg, []string{"test-authz"})
+	require.NoError(t, err)
+
+	return a, srv.Close
+}
+
+func TestIsMutatingMethod(t *testing.T) {
+	cases := map[string]bool{
+		"/docker.swarmkit.v1.Control/CreateNetwork": true,
+		"/docker.swarmkit.v1.Control/UpdateService": true,
+		"/docker.swarmkit.v1.Control/RemoveSecret":  true,
+		"/docker.swarmkit.v1.Control/GetNetwork":    false,
+		"/docker.swarmkit.v1.Control/ListServices":  false,
+	}
+	for method, want := range cases {
+		assert.Equal(t, want, isMutatingMethod(method), method)
+	}
+}
+
+func TestNewRejectsUnknownPlugin(t *testing.T) {
+	_, err := New(nil, []string{"some-authz-plugin"})
+	require.Error(t, err)
+}
+
+func TestNewWithNoPlugins(t *testing.T) {
+	a, err := New(fakePluginGetter{}, nil)
+	require.NoError(t, err)
+	require.NotNil(t, a)
+}
+
+func TestUnaryServerInterceptorPassesThroughWithNoPlugins(t *testing.T) {
+	a, err := New(fakePluginGetter{}, nil)
+	require.NoError(t, err)
+
+	called := false
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		called = true
+		return "ok", nil
+	}
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/docker.swarmkit.v1.Control/CreateNetwork"}
+	resp, err := a.UnaryServerInterceptor(context.Background(), struct{}{}, info, handler)
+	require.NoError(t, err)
+	assert.True(t, called)
+	assert.Equal(t, "ok", resp)
+}
+
+type fakeCreateNetworkRequest struct {
+	Name string
+}
+
+func TestUnaryServerInterceptorDeniesOnPluginVeto(t *testing.T) {
+	a, closeSrv := newTestAuthzPlugin(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/" + authorization.AuthZApiRequest:
+			_ = json.NewEncoder(w).Encode(authorization.Response{Allow: false, Msg: "denied by policy"})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	defer closeSrv()
+
+	called := false
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		called = true
+		return "ok", nil
+	}
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/docker.swarmkit.v1.Control/CreateNetwork"}
+	_, err := a.UnaryServerInterceptor(context.Background(), &fakeCreateNetworkRequest{Name: "hello"}, info, handler)
+	require.Error(t, err)
+	assert.False(t, called, "handler must not run once a plugin denies the request")
+	assert.Equal(t, codes.PermissionDenied, grpc.Code(err))
+	assert.Contains(t, err.Error(), "denied by policy")
+}
+
+func TestUnaryServerInterceptorAllowsAndRoundTripsBody(t *testing.T) {
+	var gotReq authorization.Request
+	var gotRes authorization.Response
+
+	a, closeSrv := newTestAuthzPlugin(t, func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		switch r.URL.Path {
+		case "/" + authorization.AuthZApiRequest:
+			require.NoError(t, json.Unmarshal(body, &gotReq))
+			_ = json.NewEncoder(w).Encode(authorization.Response{Allow: true})
+		case "/" + authorization.AuthZApiResponse:
+			require.NoError(t, json.Unmarshal(body, &gotRes))
+			_ = json.NewEncoder(w).Encode(authorization.Response{Allow: true})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	defer closeSrv()
+
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "ok", nil
+	}
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/docker.swarmkit.v1.Control/CreateNetwork"}
+	resp, err := a.UnaryServerInterceptor(context.Background(), &fakeCreateNetworkRequest{Name: "hello"}, info, handler)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", resp)
+
+	assert.Equal(t, info.FullMethod, gotReq.RequestMethod)
+	assert.Contains(t, string(gotReq.RequestBody), "hello")
+	assert.Contains(t, string(gotRes.ResponseBody), "ok")
+}
@@ -3,16 +3,171 @@ package controlapi
 import (
 	"regexp"
 	"strings"
+	"sync"
 
 	"github.com/docker/docker/pkg/plugingetter"
 	"github.com/docker/libnetwork/ipamapi"
 	"github.com/docker/swarmkit/api"
 	"github.com/docker/swarmkit/manager/allocator/networkallocator"
+	"github.com/docker/swarmkit/manager/controlapi/pluginref"
+	"github.com/docker/swarmkit/manager/controlapi/schema"
 	"github.com/docker/swarmkit/manager/state/store"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 )
 
+func init() {
+	// The overlay driver recognizes a handful of well-known options; type
+	// those so a bad value (e.g. a non-numeric MTU) is rejected up front
+	// instead of failing later in the allocator. Unrecognized options are
+	// still allowed through, same as today.
+	trueVal := true
+	schema.RegisterBuiltin("overlay", &schema.Schema{
+		Properties: map[string]*schema.Property{
+			"com.docker.network.driver.mtu":                  {Type: "integer"},
+			"com.docker.network.driver.overlay.vxlanid_list": {Type: "string"},
+		},
+		AdditionalProperties: &trueVal,
+	})
+
+	// The default IPAM driver has no typed options; registering it puts its
+	// Options on the same validation path as a plugin-backed IPAM driver's.
+	// Unrecognized options are allowed through.
+	schema.RegisterBuiltin(ipamapi.DefaultIPAM, &schema.Schema{
+		AdditionalProperties: &trueVal,
+	})
+}
+
+// pluginTrackers holds one pluginref.Tracker per plugingetter.PluginGetter
+// validateDriver is called with. In practice a manager only ever has a
+// single PluginGetter for its lifetime, so this just lazily builds a
+// singleton the first time that PluginGetter is seen.
+var (
+	pluginTrackersMu sync.Mutex
+	pluginTrackers   = map[plugingetter.PluginGetter]*pluginref.Tracker{}
+)
+
+func trackerFor(pg plugingetter.PluginGetter) *pluginref.Tracker {
+	pluginTrackersMu.Lock()
+	defer pluginTrackersMu.Unlock()
+	t, ok := pluginTrackers[pg]
+	if !ok {
+		t = pluginref.New(pg)
+		pluginTrackers[pg] = t
+	}
+	return t
+}
+
+// ReleaseDriver releases the plugin reference validateDriver's call to
+// Acquire took out for driver, once the object referencing it has been
+// removed from the store. It is meant to be called from the Remove RPC
+// handlers in network.go, service.go, secrets.go and configs.go; none of
+// those live in this vendored subset of the tree yet, so nothing calls
+// this today, but the accounting needs to stay symmetric once they do.
+func ReleaseDriver(driver *api.Driver, pg plugingetter.PluginGetter, pluginType string) {
+	if driver == nil || driver.Name == "" || pg == nil {
+		return
+	}
+	trackerFor(pg).Release(driver.Name, pluginType)
+}
+
+// DriverCapabilities reports what a plugin told us about itself via its
+// GetCapabilities endpoint, so that the result can be persisted alongside
+// the driver configuration instead of being re-queried on every read.
+//
+// TODO(swarmkit): this belongs on api.Driver once the capabilities are
+// threaded through the proto definitions; it lives here for now because
+// this tree only vendors manager/controlapi.
+type DriverCapabilities struct {
+	// RequiresMACAddress is reported by IPAM drivers that need a MAC
+	// address to derive a predictable IP address.
+	RequiresMACAddress bool
+	// RequiresRequestReplay is reported by IPAM drivers that need their
+	// outstanding allocation requests replayed after a leader election.
+	RequiresRequestReplay bool
+	// Scope is reported by network drivers as either "local" or
+	// "swarm"/"global". It is empty for IPAM drivers.
+	Scope string
+}
+
+// networkCapabilityResponse mirrors the JSON body returned by a remote
+// network driver's NetworkDriver.GetCapabilities endpoint.
+type networkCapabilityResponse struct {
+	Scope             string
+	ConnectivityScope string
+}
+
+// ipamCapabilityResponse mirrors the JSON body returned by a remote IPAM
+// driver's IpamDriver.GetCapabilities endpoint.
+type ipamCapabilityResponse struct {
+	RequiresMACAddress    bool
+	RequiresRequestReplay bool
+}
+
+// optionsSchemaResponse mirrors the JSON body returned by a remote
+// driver's {Network,Ipam}Driver.GetOptionsSchema endpoint.
+type optionsSchemaResponse struct {
+	Schema *schema.Schema
+}
+
+// optionsSchemaCache caches the schema a V2 plugin reports via
+// GetOptionsSchema, keyed by plugin name and version, so that validating a
+// driver's Options doesn't round-trip to the plugin on every Create or
+// Update RPC.
+type optionsSchemaCache struct {
+	mu    sync.Mutex
+	byKey map[string]*schema.Schema
+}
+
+var pluginOptionsSchemas = &optionsSchemaCache{byKey: make(map[string]*schema.Schema)}
+
+// get returns the options schema for p, querying the plugin on the first
+// call and caching the result under name+version. A nil schema means the
+// plugin has no RPC client, is a secret driver, or its GetOptionsSchema
+// call failed (e.g. it doesn't implement the endpoint), and is treated as
+// "no constraints to check". A failed call is not cached, so the plugin is
+// queried again on the next lookup.
+func (c *optionsSchemaCache) get(p plugingetter.CompatPlugin, pluginType string) *schema.Schema {
+	key := p.Name() + "@" + p.FullName()
+
+	c.mu.Lock()
+	s, cached := c.byKey[key]
+	c.mu.Unlock()
+	if cached {
+		return s
+	}
+
+	client := p.Client()
+	if client == nil {
+		return nil
+	}
+
+	var method string
+	switch pluginType {
+	case ipamapi.PluginEndpointType:
+		method = "IpamDriver.GetOptionsSchema"
+	case pluginref.SecretProviderPluginType:
+		// Secret (and, eventually, config) drivers don't implement the
+		// NetworkDriver schema RPC; there's nothing to validate against yet.
+		return nil
+	default:
+		method = "NetworkDriver.GetOptionsSchema"
+	}
+
+	var resp optionsSchemaResponse
+	if err := client.Call(method, nil, &resp); err != nil {
+		// Plugins that predate this endpoint simply won't implement it;
+		// there's nothing to validate driver.Options against in that case.
+		return nil
+	}
+
+	c.mu.Lock()
+	c.byKey[key] = resp.Schema
+	c.mu.Unlock()
+
+	return resp.Schema
+}
+
 var isValidDNSName = regexp.MustCompile(`^[a-zA-Z0-9](?:[-_]*[A-Za-z0-9]+)*$`)
 
 // configs and secrets have different naming requirements from tasks and services
@@ -93,41 +248,111 @@ func validateConfigOrSecretAnnotations(m api.Annotations) error {
 	return nil
 }
 
-func validateDriver(driver *api.Driver, pg plugingetter.PluginGetter, pluginType string) error {
+// validateDriver checks that driver refers to either a known built-in
+// driver or a plugin that is installed, is not a legacy (V1) plugin, and
+// reports capabilities that Swarm can work with. isSwarmScope should be
+// true when the object being validated (currently only networks) is
+// itself swarm-scoped; it is ignored for IPAM drivers. On success it
+// returns the capabilities the plugin reported, so the caller can persist
+// them alongside the driver configuration.
+func validateDriver(driver *api.Driver, pg plugingetter.PluginGetter, pluginType string, isSwarmScope bool) (caps *DriverCapabilities, err error) {
 	if driver == nil {
 		// It is ok to not specify the driver. We will choose
 		// a default driver.
-		return nil
+		return nil, nil
 	}
 
 	if driver.Name == "" {
-		return grpc.Errorf(codes.InvalidArgument, "driver name: if driver is specified name is required")
+		return nil, grpc.Errorf(codes.InvalidArgument, "driver name: if driver is specified name is required")
 	}
 
 	// First check against the known drivers
+	isBuiltin := false
 	switch pluginType {
 	case ipamapi.PluginEndpointType:
-		if strings.ToLower(driver.Name) == ipamapi.DefaultIPAM {
-			return nil
-		}
+		isBuiltin = strings.ToLower(driver.Name) == ipamapi.DefaultIPAM
+	case pluginref.SecretProviderPluginType:
+		// There is no such thing as a built-in secret/config driver; never
+		// let one collide with a network built-in of the same name (e.g. a
+		// secret driver plugin named "overlay").
+		isBuiltin = false
 	default:
-		if networkallocator.IsBuiltInDriver(driver.Name) {
-			return nil
+		isBuiltin = networkallocator.IsBuiltInDriver(driver.Name)
+	}
+	if isBuiltin {
+		if s, ok := schema.Builtin(strings.ToLower(driver.Name)); ok {
+			if err := schema.Validate(s, driver.Options); err != nil {
+				return nil, grpc.Errorf(codes.InvalidArgument, "driver %s: %v", driver.Name, err)
+			}
 		}
+		return nil, nil
 	}
 
 	if pg == nil {
-		return grpc.Errorf(codes.InvalidArgument, "plugin %s not supported", driver.Name)
+		return nil, grpc.Errorf(codes.InvalidArgument, "plugin %s not supported", driver.Name)
 	}
 
-	p, err := pg.Get(driver.Name, pluginType, plugingetter.Lookup)
+	// Resolving the plugin here also acquires a reference on it (see
+	// pluginref), so a plugin this driver depends on can't be uninstalled
+	// out from under it later. The corresponding Release happens in
+	// ReleaseDriver when the object referencing it is removed.
+	p, err := trackerFor(pg).Acquire(driver.Name, pluginType)
 	if err != nil {
-		return grpc.Errorf(codes.InvalidArgument, "error during lookup of plugin %s", driver.Name)
+		return nil, grpc.Errorf(codes.InvalidArgument, "error during lookup of plugin %s", driver.Name)
 	}
+	// A driver rejected below is never persisted, so no object will ever
+	// release the reference taken above; give it back right away.
+	defer func() {
+		if err != nil {
+			trackerFor(pg).Release(driver.Name, pluginType)
+		}
+	}()
 
 	if p.IsV1() {
-		return grpc.Errorf(codes.InvalidArgument, "legacy plugin %s of type %s is not supported in swarm mode", driver.Name, pluginType)
+		return nil, grpc.Errorf(codes.InvalidArgument, "legacy plugin %s of type %s is not supported in swarm mode", driver.Name, pluginType)
 	}
 
-	return nil
+	if s := pluginOptionsSchemas.get(p, pluginType); s != nil {
+		if err := schema.Validate(s, driver.Options); err != nil {
+			return nil, grpc.Errorf(codes.InvalidArgument, "driver %s: %v", driver.Name, err)
+		}
+	}
+
+	return queryDriverCapabilities(p, pluginType, isSwarmScope)
+}
+
+// queryDriverCapabilities calls the plugin's GetCapabilities endpoint and
+// translates the result into a DriverCapabilities, rejecting the plugin if
+// it cannot satisfy what swarm mode needs.
+func queryDriverCapabilities(p plugingetter.CompatPlugin, pluginType string, isSwarmScope bool) (*DriverCapabilities, error) {
+	client := p.Client()
+	if client == nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "plugin %s did not return an RPC client", p.Name())
+	}
+
+	switch pluginType {
+	case ipamapi.PluginEndpointType:
+		var resp ipamCapabilityResponse
+		if err := client.Call("IpamDriver.GetCapabilities", nil, &resp); err != nil {
+			return nil, grpc.Errorf(codes.InvalidArgument, "error querying capabilities of plugin %s: %v", p.Name(), err)
+		}
+		return &DriverCapabilities{
+			RequiresMACAddress:    resp.RequiresMACAddress,
+			RequiresRequestReplay: resp.RequiresRequestReplay,
+		}, nil
+	case pluginref.SecretProviderPluginType:
+		// Secret (and, eventually, config) drivers don't implement the
+		// NetworkDriver capability RPC; there's nothing to query or
+		// reject them on.
+		return nil, nil
+	default:
+		var resp networkCapabilityResponse
+		if err := client.Call("NetworkDriver.GetCapabilities", nil, &resp); err != nil {
+			return nil, grpc.Errorf(codes.InvalidArgument, "error querying capabilities of plugin %s: %v", p.Name(), err)
+		}
+		if isSwarmScope && strings.ToLower(resp.Scope) == "local" {
+			return nil, grpc.Errorf(codes.InvalidArgument, "network driver %s has local scope and cannot be used for a swarm-scoped network", p.Name())
+		}
+		return &DriverCapabilities{Scope: resp.Scope}, nil
+	}
 }
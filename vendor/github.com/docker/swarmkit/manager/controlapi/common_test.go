@@ -0,0 +1,158 @@
+package controlapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/docker/docker/pkg/plugingetter"
+	"github.com/docker/docker/pkg/plugins"
+	"github.com/docker/go-connections/tlsconfig"
+	"github.com/docker/libnetwork/ipamapi"
+	"github.com/docker/swarmkit/api"
+	"github.com/docker/swarmkit/manager/controlapi/pluginref"
+	"github.com/docker/swarmkit/manager/controlapi/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// fakeCompatPlugin wraps a real *plugins.Client pointed at a test HTTP
+// server, so validateDriver's RPC calls (GetCapabilities,
+// GetOptionsSchema) exercise the actual wire format instead of stubbing
+// out client.Call.
+type fakeCompatPlugin struct {
+	name   string
+	client *plugins.Client
+}
+
+func (p *fakeCompatPlugin) Client() *plugins.Client    { return p.client }
+func (p *fakeCompatPlugin) Name() string               { return p.name }
+func (p *fakeCompatPlugin) FullName() string           { return p.name }
+func (p *fakeCompatPlugin) BasePath() string           { return "" }
+func (p *fakeCompatPlugin) IsV1() bool                 { return false }
+func (p *fakeCompatPlugin) ScopedPath(s string) string { return s }
+
+// singlePluginGetter always resolves to the same plugin, regardless of the
+// name or mode it's asked for.
+type singlePluginGetter struct {
+	plugin plugingetter.CompatPlugin
+}
+
+func (g singlePluginGetter) Get(name, capability string, mode int) (plugingetter.CompatPlugin, error) {
+	return g.plugin, nil
+}
+func (singlePluginGetter) GetAllByCap(capability string) ([]plugingetter.CompatPlugin, error) {
+	return nil, nil
+}
+func (singlePluginGetter) GetAllManagedPluginsByCap(capability string) []plugingetter.CompatPlugin {
+	return nil
+}
+func (singlePluginGetter) Handle(capability string, callback func(string, *plugins.Client)) {}
+
+// newTestDriverPlugin spins up an httptest.Server running handler and
+// returns a plugingetter.PluginGetter that always resolves name to a
+// CompatPlugin backed by it.
+func newTestDriverPlugin(t *testing.T, name string, handler http.HandlerFunc) (plugingetter.PluginGetter, func()) {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+
+	client, err := plugins.NewClient(srv.URL, &tlsconfig.Options{InsecureSkipVerify: true})
+	require.NoError(t, err)
+
+	pg := singlePluginGetter{plugin: &fakeCompatPlugin{name: name, client: client}}
+	return pg, srv.Close
+}
+
+func TestValidateDriverRejectsLocalScopeForSwarmScopedNetwork(t *testing.T) {
+	pg, closeSrv := newTestDriverPlugin(t, "local-net-driver", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/NetworkDriver.GetCapabilities":
+			_ = json.NewEncoder(w).Encode(networkCapabilityResponse{Scope: "local"})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	defer closeSrv()
+
+	driver := &api.Driver{Name: "local-net-driver"}
+	_, err := validateDriver(driver, pg, pluginref.NetworkPluginType, true)
+	require.Error(t, err)
+	assert.Equal(t, codes.InvalidArgument, grpc.Code(err))
+	assert.Contains(t, err.Error(), "local scope")
+}
+
+func TestValidateDriverSurfacesIPAMCapabilities(t *testing.T) {
+	pg, closeSrv := newTestDriverPlugin(t, "my-ipam-driver", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/IpamDriver.GetCapabilities":
+			_ = json.NewEncoder(w).Encode(ipamCapabilityResponse{
+				RequiresMACAddress:    true,
+				RequiresRequestReplay: true,
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	defer closeSrv()
+
+	driver := &api.Driver{Name: "my-ipam-driver"}
+	caps, err := validateDriver(driver, pg, ipamapi.PluginEndpointType, false)
+	require.NoError(t, err)
+	require.NotNil(t, caps)
+	assert.True(t, caps.RequiresMACAddress)
+	assert.True(t, caps.RequiresRequestReplay)
+}
+
+func TestOptionsSchemaCacheOnlyQueriesOnce(t *testing.T) {
+	calls := 0
+	trueVal := true
+	pg, closeSrv := newTestDriverPlugin(t, "schema-cache-driver", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/NetworkDriver.GetOptionsSchema":
+			calls++
+			_ = json.NewEncoder(w).Encode(optionsSchemaResponse{
+				Schema: &schema.Schema{AdditionalProperties: &trueVal},
+			})
+		case "/NetworkDriver.GetCapabilities":
+			_ = json.NewEncoder(w).Encode(networkCapabilityResponse{Scope: "global"})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	defer closeSrv()
+
+	driver := &api.Driver{Name: "schema-cache-driver"}
+	_, err := validateDriver(driver, pg, pluginref.NetworkPluginType, true)
+	require.NoError(t, err)
+	_, err = validateDriver(driver, pg, pluginref.NetworkPluginType, true)
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, calls, "GetOptionsSchema must only be queried once; later lookups should hit the cache")
+}
+
+func TestValidateDriverRejectsOptionsViolatingPluginSchema(t *testing.T) {
+	falseVal := false
+	pg, closeSrv := newTestDriverPlugin(t, "strict-schema-driver", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/NetworkDriver.GetOptionsSchema":
+			_ = json.NewEncoder(w).Encode(optionsSchemaResponse{
+				Schema: &schema.Schema{AdditionalProperties: &falseVal},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	defer closeSrv()
+
+	driver := &api.Driver{
+		Name:    "strict-schema-driver",
+		Options: map[string]string{"not-a-recognized-option": "x"},
+	}
+	_, err := validateDriver(driver, pg, pluginref.NetworkPluginType, false)
+	require.Error(t, err)
+	assert.Equal(t, codes.InvalidArgument, grpc.Code(err))
+}
@@ -0,0 +1,249 @@
+// Package pluginref tracks which plugins swarm objects (networks, services,
+// secrets, configs) depend on, so that removing a plugin that is still in
+// use by the swarm can be refused by the plugin manager.
+//
+// controlapi used to look plugins up with plugingetter.Lookup, which never
+// touches the plugin's refcount. That made it possible to uninstall a
+// plugin out from under a running network or service. Tracker instead
+// acquires a reference the first time an object references a driver
+// plugin, and releases it once nothing references that plugin anymore.
+package pluginref
+
+import (
+	"sync"
+
+	"github.com/docker/docker/pkg/plugingetter"
+	"github.com/docker/libnetwork/ipamapi"
+	"github.com/docker/swarmkit/log"
+	"github.com/docker/swarmkit/manager/state/store"
+)
+
+const (
+	// NetworkPluginType is the capability network driver plugins register
+	// under (driverapi.NetworkPluginEndpointType upstream). It is kept as
+	// a local constant because this tree only vendors manager/controlapi,
+	// not driverapi.
+	NetworkPluginType = "NetworkDriver"
+	// SecretProviderPluginType is the capability swarm's external secret
+	// driver support looks plugins up under.
+	SecretProviderPluginType = "SecretProvider"
+)
+
+// key identifies a plugin the way plugingetter.Get does: by name and by
+// the capability (plugin type) it was looked up under.
+type key struct {
+	name       string
+	pluginType string
+}
+
+// Tracker acquires and releases plugin references through a
+// plugingetter.PluginGetter on behalf of swarm objects. It keeps its own
+// count of how many swarm objects reference a given plugin, and only calls
+// through to pg on the 0->1 and 1->0 transitions, so that Reconcile can be
+// run repeatedly without leaking extra references.
+type Tracker struct {
+	pg plugingetter.PluginGetter
+
+	mu      sync.Mutex
+	refs    map[key]int
+	plugins map[key]plugingetter.CompatPlugin
+}
+
+// New returns a Tracker backed by pg. pg may be nil, in which case Acquire,
+// Release and Reconcile are no-ops (this mirrors how validateDriver treats
+// a nil PluginGetter as "no plugin support available").
+func New(pg plugingetter.PluginGetter) *Tracker {
+	return &Tracker{
+		pg:      pg,
+		refs:    make(map[key]int),
+		plugins: make(map[key]plugingetter.CompatPlugin),
+	}
+}
+
+// Acquire resolves the named plugin of the given type and records that one
+// more swarm object references it, in a single step: this is the
+// replacement for the plugingetter.Lookup call validateDriver used to make,
+// so that a plugin's refcount is bumped at the same point it's validated.
+// The underlying plugin reference is only acquired the first time a given
+// (name, pluginType) is seen; later calls reuse the already-resolved
+// plugin. Built-in drivers are not special-cased: a name with no matching
+// plugin, a built-in driver's included, returns the lookup error from pg.
+func (t *Tracker) Acquire(name, pluginType string) (plugingetter.CompatPlugin, error) {
+	if t.pg == nil || name == "" {
+		return nil, nil
+	}
+
+	k := key{name, pluginType}
+
+	t.mu.Lock()
+	if p, ok := t.plugins[k]; ok {
+		t.refs[k]++
+		t.mu.Unlock()
+		return p, nil
+	}
+	t.mu.Unlock()
+
+	p, err := t.pg.Get(name, pluginType, plugingetter.Acquire)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	if existing, ok := t.plugins[k]; ok {
+		// Another caller resolved this plugin while the lock was dropped;
+		// keep a single underlying reference.
+		t.refs[k]++
+		t.mu.Unlock()
+		if _, err := t.pg.Get(name, pluginType, plugingetter.Release); err != nil {
+			log.L.WithError(err).Debugf("unable to release reference on plugin %s (%s)", name, pluginType)
+		}
+		return existing, nil
+	}
+	t.refs[k]++
+	t.plugins[k] = p
+	t.mu.Unlock()
+
+	return p, nil
+}
+
+// Release records that one fewer swarm object references the named plugin
+// of the given type, releasing the underlying plugin reference once the
+// last one goes away.
+func (t *Tracker) Release(name, pluginType string) {
+	if t.pg == nil || name == "" {
+		return
+	}
+
+	k := key{name, pluginType}
+	t.mu.Lock()
+	if t.refs[k] == 0 {
+		// Nothing was acquired through this Tracker, so there is no
+		// reference to give back.
+		t.mu.Unlock()
+		return
+	}
+	t.refs[k]--
+	last := t.refs[k] == 0
+	if last {
+		delete(t.refs, k)
+		delete(t.plugins, k)
+	}
+	t.mu.Unlock()
+
+	if !last {
+		return
+	}
+	if _, err := t.pg.Get(name, pluginType, plugingetter.Release); err != nil {
+		log.L.WithError(err).Debugf("unable to release reference on plugin %s (%s)", name, pluginType)
+	}
+}
+
+// Reconcile rebuilds plugin refcounts from scratch by walking every object
+// in s that can reference a driver plugin. Refcounts are kept in memory
+// and do not survive a leadership change, so this must be called once a
+// manager wins leader election, before it starts serving controlapi
+// requests. It is safe to call repeatedly: plugins already accounted for
+// are not re-acquired, and plugins no longer referenced by anything in the
+// store are released.
+//
+// wanted counts how many objects in the store reference each plugin, not
+// just whether any do: a driver referenced by two networks must end up
+// with t.refs[k] == 2, so that a future election that finds only one of
+// them still around (the other having been removed, and Released, in the
+// meantime) drops the count to 1 instead of 0 and keeps the plugin
+// reference held on the remaining network's behalf.
+//
+// Lookup failures while walking the store are logged as warnings rather
+// than returned: a plugin that was removed out-of-band while this manager
+// was not the leader shouldn't block it from taking over.
+func (t *Tracker) Reconcile(s store.Store) error {
+	if t.pg == nil {
+		return nil
+	}
+
+	wanted := make(map[key]int)
+
+	err := s.View(func(tx store.ReadTx) error {
+		networks, err := store.FindNetworks(tx, store.All)
+		if err != nil {
+			return err
+		}
+		for _, n := range networks {
+			if d := n.Spec.DriverConfig; d != nil && d.Name != "" {
+				wanted[key{d.Name, NetworkPluginType}]++
+			}
+			if ipam := n.Spec.IPAM; ipam != nil && ipam.Driver != nil && ipam.Driver.Name != "" {
+				wanted[key{ipam.Driver.Name, ipamapi.PluginEndpointType}]++
+			}
+		}
+
+		// Services reference networks by ID, not by driver, so there is no
+		// separate plugin reference to acquire for them here.
+
+		secrets, err := store.FindSecrets(tx, store.All)
+		if err != nil {
+			return err
+		}
+		for _, sec := range secrets {
+			if d := sec.Spec.Driver; d != nil && d.Name != "" {
+				wanted[key{d.Name, SecretProviderPluginType}]++
+			}
+		}
+
+		// Configs do not yet support an external driver in this version of
+		// swarmkit, and volumes are not modeled in the store at all, so
+		// neither has a plugin reference to reconcile.
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	stale := make([]key, 0, len(t.refs))
+	for k := range t.refs {
+		if _, ok := wanted[k]; !ok {
+			stale = append(stale, k)
+		}
+	}
+	missing := make(map[key]int, len(wanted))
+	for k, n := range wanted {
+		if _, ok := t.refs[k]; !ok {
+			missing[k] = n
+			continue
+		}
+		// Already holding a reference on this plugin from before the
+		// election; just bring the refcount in line with the store's true
+		// count of referencing objects, without another round-trip to the
+		// plugin manager.
+		t.refs[k] = n
+	}
+	t.mu.Unlock()
+
+	for k, n := range missing {
+		p, err := t.pg.Get(k.name, k.pluginType, plugingetter.Acquire)
+		if err != nil {
+			// The plugin may have been removed out-of-band while this
+			// manager wasn't the leader; that shouldn't block it from
+			// taking over.
+			log.L.WithError(err).Warnf("unable to acquire reference on plugin %s (%s) during reconcile", k.name, k.pluginType)
+			continue
+		}
+		t.mu.Lock()
+		t.refs[k] = n
+		t.plugins[k] = p
+		t.mu.Unlock()
+	}
+	for _, k := range stale {
+		t.mu.Lock()
+		delete(t.refs, k)
+		delete(t.plugins, k)
+		t.mu.Unlock()
+		if _, err := t.pg.Get(k.name, k.pluginType, plugingetter.Release); err != nil {
+			log.L.WithError(err).Debugf("unable to release reference on plugin %s (%s)", k.name, k.pluginType)
+		}
+	}
+
+	return nil
+}
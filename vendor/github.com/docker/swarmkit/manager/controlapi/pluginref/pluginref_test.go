@@ -0,0 +1,227 @@
+package pluginref
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/docker/docker/pkg/plugingetter"
+	"github.com/docker/docker/pkg/plugins"
+	"github.com/docker/swarmkit/api"
+	"github.com/docker/swarmkit/manager/state/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakePluginGetter counts Acquire/Release calls per plugin name so tests
+// can assert on refcounts without a real plugin manager.
+type fakePluginGetter struct {
+	refs map[string]int
+}
+
+func newFakePluginGetter() *fakePluginGetter {
+	return &fakePluginGetter{refs: make(map[string]int)}
+}
+
+func (f *fakePluginGetter) Get(name, capability string, mode int) (plugingetter.CompatPlugin, error) {
+	switch mode {
+	case plugingetter.Acquire:
+		f.refs[name]++
+	case plugingetter.Release:
+		f.refs[name]--
+	}
+	return fakeCompatPlugin(name), nil
+}
+
+// fakeCompatPlugin is just enough of a plugingetter.CompatPlugin for
+// Tracker to cache and hand back; its only property tests care about is
+// its identity.
+type fakeCompatPlugin string
+
+func (f fakeCompatPlugin) Client() *plugins.Client {
+	return nil
+}
+func (f fakeCompatPlugin) Name() string     { return string(f) }
+func (f fakeCompatPlugin) FullName() string { return string(f) }
+func (f fakeCompatPlugin) BasePath() string { return "" }
+func (f fakeCompatPlugin) IsV1() bool       { return false }
+func (f fakeCompatPlugin) ScopedPath(s string) string {
+	return s
+}
+
+// erroringPluginGetter always fails Get, simulating a plugin that has
+// been removed out-of-band.
+type erroringPluginGetter struct{}
+
+func (erroringPluginGetter) Get(name, capability string, mode int) (plugingetter.CompatPlugin, error) {
+	return nil, errors.New("plugin not found")
+}
+func (erroringPluginGetter) GetAllByCap(capability string) ([]plugingetter.CompatPlugin, error) {
+	return nil, nil
+}
+func (erroringPluginGetter) GetAllManagedPluginsByCap(capability string) []plugingetter.CompatPlugin {
+	return nil
+}
+func (erroringPluginGetter) Handle(capability string, callback func(string, *plugins.Client)) {}
+
+func TestTrackerAcquirePropagatesLookupError(t *testing.T) {
+	tr := New(erroringPluginGetter{})
+	p, err := tr.Acquire("missing-driver", NetworkPluginType)
+	require.Error(t, err)
+	assert.Nil(t, p)
+}
+
+func (f *fakePluginGetter) GetAllByCap(capability string) ([]plugingetter.CompatPlugin, error) {
+	return nil, nil
+}
+
+func (f *fakePluginGetter) GetAllManagedPluginsByCap(capability string) []plugingetter.CompatPlugin {
+	return nil
+}
+
+func (f *fakePluginGetter) Handle(capability string, callback func(string, *plugins.Client)) {}
+
+func TestTrackerAcquireRelease(t *testing.T) {
+	pg := newFakePluginGetter()
+	tr := New(pg)
+
+	// Two objects referencing the same plugin only acquire the
+	// underlying plugin reference once, and both get back the resolved
+	// plugin.
+	p1, err := tr.Acquire("my-driver", NetworkPluginType)
+	require.NoError(t, err)
+	p2, err := tr.Acquire("my-driver", NetworkPluginType)
+	require.NoError(t, err)
+	assert.Equal(t, p1, p2)
+	assert.Equal(t, 1, pg.refs["my-driver"])
+
+	// Releasing one of the two objects must not drop the reference yet.
+	tr.Release("my-driver", NetworkPluginType)
+	assert.Equal(t, 1, pg.refs["my-driver"])
+
+	// Releasing the last object drops the underlying reference.
+	tr.Release("my-driver", NetworkPluginType)
+	assert.Equal(t, 0, pg.refs["my-driver"])
+}
+
+func TestTrackerNilPluginGetter(t *testing.T) {
+	tr := New(nil)
+	// Must not panic.
+	p, err := tr.Acquire("my-driver", NetworkPluginType)
+	require.NoError(t, err)
+	assert.Nil(t, p)
+	tr.Release("my-driver", NetworkPluginType)
+	require.NoError(t, tr.Reconcile(store.NewMemoryStore(nil)))
+}
+
+func TestTrackerReconcileIsIdempotent(t *testing.T) {
+	s := store.NewMemoryStore(nil)
+	require.NotNil(t, s)
+
+	network := &api.Network{
+		ID: "net1",
+		Spec: api.NetworkSpec{
+			Annotations: api.Annotations{Name: "net1"},
+			DriverConfig: &api.Driver{
+				Name: "my-network-driver",
+			},
+		},
+	}
+	secret := &api.Secret{
+		ID: "secret1",
+		Spec: api.SecretSpec{
+			Annotations: api.Annotations{Name: "secret1"},
+			Driver: &api.Driver{
+				Name: "my-secret-driver",
+			},
+		},
+	}
+
+	err := s.Update(func(tx store.Tx) error {
+		if err := store.CreateNetwork(tx, network); err != nil {
+			return err
+		}
+		return store.CreateSecret(tx, secret)
+	})
+	require.NoError(t, err)
+
+	pg := newFakePluginGetter()
+	tr := New(pg)
+
+	require.NoError(t, tr.Reconcile(s))
+	assert.Equal(t, 1, pg.refs["my-network-driver"])
+	assert.Equal(t, 1, pg.refs["my-secret-driver"])
+
+	// Reconcile is called again on every leader election; it must not keep
+	// piling up references for objects that were already accounted for.
+	require.NoError(t, tr.Reconcile(s))
+	assert.Equal(t, 1, pg.refs["my-network-driver"])
+	assert.Equal(t, 1, pg.refs["my-secret-driver"])
+}
+
+// TestTrackerReconcileAcrossElectionsWithSharedDriver covers the case where
+// more than one object in the store references the same driver: the
+// underlying plugin must stay acquired with the plugin manager until the
+// last referencing object is gone, even across a leader election that
+// rebuilds the Tracker's refcounts from scratch in between.
+func TestTrackerReconcileAcrossElectionsWithSharedDriver(t *testing.T) {
+	s := store.NewMemoryStore(nil)
+	require.NotNil(t, s)
+
+	net1 := &api.Network{
+		ID: "net1",
+		Spec: api.NetworkSpec{
+			Annotations:  api.Annotations{Name: "net1"},
+			DriverConfig: &api.Driver{Name: "weave"},
+		},
+	}
+	net2 := &api.Network{
+		ID: "net2",
+		Spec: api.NetworkSpec{
+			Annotations:  api.Annotations{Name: "net2"},
+			DriverConfig: &api.Driver{Name: "weave"},
+		},
+	}
+
+	require.NoError(t, s.Update(func(tx store.Tx) error {
+		if err := store.CreateNetwork(tx, net1); err != nil {
+			return err
+		}
+		return store.CreateNetwork(tx, net2)
+	}))
+
+	pg := newFakePluginGetter()
+	tr := New(pg)
+
+	// Two networks reference the same driver: the plugin manager only sees
+	// a single Acquire, but the Tracker's internal refcount must reflect
+	// both referencing objects.
+	require.NoError(t, tr.Reconcile(s))
+	assert.Equal(t, 1, pg.refs["weave"])
+	assert.Equal(t, 2, tr.refs[key{"weave", NetworkPluginType}])
+
+	// A new leader is elected (a fresh Reconcile, as would happen after
+	// failover) while both networks still exist: the count must not change.
+	require.NoError(t, tr.Reconcile(s))
+	assert.Equal(t, 1, pg.refs["weave"])
+	assert.Equal(t, 2, tr.refs[key{"weave", NetworkPluginType}])
+
+	// One of the two networks is removed, then another election happens.
+	// The driver is still referenced by net2, so the plugin reference must
+	// stay held.
+	require.NoError(t, s.Update(func(tx store.Tx) error {
+		return store.DeleteNetwork(tx, net1.ID)
+	}))
+	require.NoError(t, tr.Reconcile(s))
+	assert.Equal(t, 1, pg.refs["weave"])
+	assert.Equal(t, 1, tr.refs[key{"weave", NetworkPluginType}])
+
+	// The last referencing object is removed: now the plugin reference is
+	// actually released.
+	require.NoError(t, s.Update(func(tx store.Tx) error {
+		return store.DeleteNetwork(tx, net2.ID)
+	}))
+	require.NoError(t, tr.Reconcile(s))
+	assert.Equal(t, 0, pg.refs["weave"])
+	_, stillTracked := tr.refs[key{"weave", NetworkPluginType}]
+	assert.False(t, stillTracked)
+}
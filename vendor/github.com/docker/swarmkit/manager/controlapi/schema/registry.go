@@ -0,0 +1,27 @@
+package schema
+
+import "sync"
+
+var (
+	builtinMu sync.Mutex
+	builtin   = map[string]*Schema{}
+)
+
+// RegisterBuiltin registers the options schema for a built-in driver (one
+// for which networkallocator.IsBuiltInDriver or ipamapi.DefaultIPAM
+// returns true), so that its Options get the same validation a plugin-
+// backed driver's would. It is called from an init() function; controlapi
+// registers the overlay and default IPAM schemas this way.
+func RegisterBuiltin(name string, s *Schema) {
+	builtinMu.Lock()
+	defer builtinMu.Unlock()
+	builtin[name] = s
+}
+
+// Builtin returns the schema registered for name, if any.
+func Builtin(name string) (*Schema, bool) {
+	builtinMu.Lock()
+	defer builtinMu.Unlock()
+	s, ok := builtin[name]
+	return s, ok
+}
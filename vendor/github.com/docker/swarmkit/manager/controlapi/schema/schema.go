@@ -0,0 +1,123 @@
+// Package schema implements just enough of JSON Schema draft-07 — type,
+// required, enum, pattern and additionalProperties — to describe the legal
+// keys of a driver's Options map. It deliberately does not pull in a
+// general-purpose JSON Schema library: driver options are always a flat
+// map[string]string, so the full spec (refs, sub-schemas, numeric ranges,
+// combinators, ...) is more than this needs.
+package schema
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// Schema describes the legal shape of a driver's Options map.
+type Schema struct {
+	Properties           map[string]*Property `json:"properties"`
+	Required             []string             `json:"required"`
+	AdditionalProperties *bool                `json:"additionalProperties"`
+}
+
+// Property describes the constraints on a single option value. Driver
+// options are always strings on the wire, so Type validates the string
+// form of the value rather than its JSON type.
+type Property struct {
+	Type    string   `json:"type"`
+	Enum    []string `json:"enum"`
+	Pattern string   `json:"pattern"`
+}
+
+// ValidationError reports which property of a driver's Options failed
+// validation and why.
+type ValidationError struct {
+	Property string
+	Message  string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("option %q: %s", e.Property, e.Message)
+}
+
+// Validate checks options against s, returning a *ValidationError naming
+// the first offending property it finds. A nil Schema allows anything, the
+// same as an absent driver options schema today.
+func Validate(s *Schema, options map[string]string) error {
+	if s == nil {
+		return nil
+	}
+
+	for _, name := range s.Required {
+		if _, ok := options[name]; !ok {
+			return &ValidationError{Property: name, Message: "is required"}
+		}
+	}
+
+	for name, value := range options {
+		prop, known := s.Properties[name]
+		if !known {
+			if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				return &ValidationError{Property: name, Message: "is not a recognized option"}
+			}
+			continue
+		}
+		if err := validateProperty(name, value, prop); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validateProperty(name, value string, prop *Property) error {
+	if err := validateType(value, prop.Type); err != nil {
+		return &ValidationError{Property: name, Message: err.Error()}
+	}
+
+	if prop.Pattern != "" {
+		re, err := regexp.Compile(prop.Pattern)
+		if err != nil {
+			return &ValidationError{Property: name, Message: fmt.Sprintf("schema has an invalid pattern: %v", err)}
+		}
+		if !re.MatchString(value) {
+			return &ValidationError{Property: name, Message: fmt.Sprintf("value %q does not match pattern %q", value, prop.Pattern)}
+		}
+	}
+
+	if len(prop.Enum) > 0 && !stringInSlice(value, prop.Enum) {
+		return &ValidationError{Property: name, Message: fmt.Sprintf("value %q is not one of %v", value, prop.Enum)}
+	}
+
+	return nil
+}
+
+func validateType(value, typ string) error {
+	switch typ {
+	case "", "string":
+		return nil
+	case "boolean":
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("value %q is not a boolean", value)
+		}
+	case "integer":
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return fmt.Errorf("value %q is not an integer", value)
+		}
+	case "number":
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return fmt.Errorf("value %q is not a number", value)
+		}
+	default:
+		return fmt.Errorf("schema has an unsupported type %q", typ)
+	}
+	return nil
+}
+
+func stringInSlice(v string, list []string) bool {
+	for _, c := range list {
+		if c == v {
+			return true
+		}
+	}
+	return false
+}
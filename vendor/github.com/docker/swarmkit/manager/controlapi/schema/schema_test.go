@@ -0,0 +1,87 @@
+package schema
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func boolPtr(b bool) *bool { return &b }
+
+func TestValidateNilSchema(t *testing.T) {
+	assert.NoError(t, Validate(nil, map[string]string{"anything": "goes"}))
+}
+
+func TestValidateRequired(t *testing.T) {
+	s := &Schema{Required: []string{"mtu"}}
+
+	err := Validate(s, map[string]string{})
+	require.Error(t, err)
+	verr, ok := err.(*ValidationError)
+	require.True(t, ok)
+	assert.Equal(t, "mtu", verr.Property)
+
+	assert.NoError(t, Validate(s, map[string]string{"mtu": "1500"}))
+}
+
+func TestValidateType(t *testing.T) {
+	s := &Schema{Properties: map[string]*Property{
+		"mtu": {Type: "integer"},
+	}}
+
+	assert.NoError(t, Validate(s, map[string]string{"mtu": "1500"}))
+
+	err := Validate(s, map[string]string{"mtu": "not-a-number"})
+	require.Error(t, err)
+	assert.Equal(t, "mtu", err.(*ValidationError).Property)
+}
+
+func TestValidateEnum(t *testing.T) {
+	s := &Schema{Properties: map[string]*Property{
+		"mode": {Enum: []string{"overlay", "host"}},
+	}}
+
+	assert.NoError(t, Validate(s, map[string]string{"mode": "host"}))
+
+	err := Validate(s, map[string]string{"mode": "bogus"})
+	require.Error(t, err)
+	assert.Equal(t, "mode", err.(*ValidationError).Property)
+}
+
+func TestValidatePattern(t *testing.T) {
+	s := &Schema{Properties: map[string]*Property{
+		"subnet": {Pattern: `^\d+\.\d+\.\d+\.\d+/\d+$`},
+	}}
+
+	assert.NoError(t, Validate(s, map[string]string{"subnet": "10.0.0.0/24"}))
+
+	err := Validate(s, map[string]string{"subnet": "not-a-cidr"})
+	require.Error(t, err)
+	assert.Equal(t, "subnet", err.(*ValidationError).Property)
+}
+
+func TestValidateAdditionalProperties(t *testing.T) {
+	s := &Schema{
+		Properties:           map[string]*Property{"mtu": {Type: "integer"}},
+		AdditionalProperties: boolPtr(false),
+	}
+
+	assert.NoError(t, Validate(s, map[string]string{"mtu": "1500"}))
+
+	err := Validate(s, map[string]string{"mtu": "1500", "typo": "oops"})
+	require.Error(t, err)
+	assert.Equal(t, "typo", err.(*ValidationError).Property)
+}
+
+func TestBuiltinRegistry(t *testing.T) {
+	_, ok := Builtin("does-not-exist")
+	assert.False(t, ok)
+
+	s := &Schema{Required: []string{"foo"}}
+	RegisterBuiltin("test-driver", s)
+
+	got, ok := Builtin("test-driver")
+	require.True(t, ok)
+	assert.Same(t, s, got)
+}